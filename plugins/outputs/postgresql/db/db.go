@@ -0,0 +1,57 @@
+package db
+
+import (
+	"github.com/jackc/pgx"
+)
+
+// Wrapper is the interface through which the rest of the plugin talks to
+// PostgreSQL. It exists so that the query/exec paths can be mocked out in
+// tests without standing up a real connection.
+type Wrapper interface {
+	Exec(query string, args ...interface{}) (pgx.CommandTag, error)
+	DoCopy(fullTableName *pgx.Identifier, colNames []string, batch [][]interface{}) error
+	Query(query string, args ...interface{}) (*pgx.Rows, error)
+	QueryRow(query string, args ...interface{}) *pgx.Row
+	Close() error
+	IsAlive() bool
+}
+
+// pgxWrapper is the Wrapper implementation backed by a real pgx connection.
+type pgxWrapper struct {
+	conn *pgx.Conn
+}
+
+// NewWrapper connects to PostgreSQL using connConfig and returns a Wrapper
+// backed by the resulting connection.
+func NewWrapper(connConfig pgx.ConnConfig) (Wrapper, error) {
+	conn, err := pgx.Connect(connConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &pgxWrapper{conn: conn}, nil
+}
+
+func (p *pgxWrapper) Exec(query string, args ...interface{}) (pgx.CommandTag, error) {
+	return p.conn.Exec(query, args...)
+}
+
+func (p *pgxWrapper) Query(query string, args ...interface{}) (*pgx.Rows, error) {
+	return p.conn.Query(query, args...)
+}
+
+func (p *pgxWrapper) QueryRow(query string, args ...interface{}) *pgx.Row {
+	return p.conn.QueryRow(query, args...)
+}
+
+func (p *pgxWrapper) DoCopy(fullTableName *pgx.Identifier, colNames []string, batch [][]interface{}) error {
+	_, err := p.conn.CopyFrom(*fullTableName, colNames, pgx.CopyFromRows(batch))
+	return err
+}
+
+func (p *pgxWrapper) Close() error {
+	return p.conn.Close()
+}
+
+func (p *pgxWrapper) IsAlive() bool {
+	return p.conn.IsAlive()
+}
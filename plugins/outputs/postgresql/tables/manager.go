@@ -0,0 +1,456 @@
+package tables
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf/plugins/outputs/postgresql/db"
+	"github.com/influxdata/telegraf/plugins/outputs/postgresql/utils"
+)
+
+// Default retry settings used when NewManager is given a zero value for the
+// corresponding parameter.
+const (
+	DefaultTableCreateRetries              = 3
+	DefaultTableCreateRetryInitialInterval = 250 * time.Millisecond
+	DefaultTableCreateRetryMaxInterval     = 5 * time.Second
+)
+
+// PartitionBy selects the time range a metric table's partitions cover.
+type PartitionBy string
+
+const (
+	PartitionNone    PartitionBy = "none"
+	PartitionDaily   PartitionBy = "daily"
+	PartitionWeekly  PartitionBy = "weekly"
+	PartitionMonthly PartitionBy = "monthly"
+)
+
+// TableManager creates and evolves the physical tables a metric's columns
+// are written to.
+type TableManager interface {
+	Exists(tableName string) bool
+	// CreateTable creates tableName (and, if colDetails' column count would
+	// push it over the manager's column limit, one or more "<tableName>_extN"
+	// overflow tables) for writing metrics with the given timestamp. When
+	// partitioning is enabled, ts selects which time-range partition is
+	// (created and) written to. The returned PlacementPlan describes which
+	// columns landed in which physical table, so the writer can split the
+	// batch accordingly.
+	CreateTable(tableName string, colDetails *utils.TargetColumns, ts time.Time) (*PlacementPlan, error)
+	// EnsureColumns makes sure tableName exists and has every column
+	// described by colDetails, creating the table (or tables, should
+	// colDetails now overflow the column limit) or adding the missing
+	// columns as needed. Like CreateTable, it returns a PlacementPlan
+	// describing which columns live in which physical table.
+	EnsureColumns(tableName string, colDetails *utils.TargetColumns, ts time.Time) (*PlacementPlan, error)
+}
+
+// defTableManager is the default TableManager implementation. It keeps a
+// local cache of which columns are known to exist on which tables so that
+// most writes don't need to round-trip to the database to check.
+type defTableManager struct {
+	// Tables maps a table name to the set of column names known to exist on
+	// it. A table is considered known to exist once it has an (possibly
+	// empty) entry in this map.
+	Tables map[string]map[string]bool
+
+	db               db.Wrapper
+	schema           string
+	tableTemplate    string
+	tagTableTemplate string
+
+	// retries is how many additional times a transient DDL error is retried
+	// before it's given up on and returned to the caller.
+	retries              int
+	retryInitialInterval time.Duration
+	retryMaxInterval     time.Duration
+
+	// partitionBy selects the time range covered by each child partition of
+	// a metric table; PartitionNone (or the empty zero value) disables
+	// partitioning.
+	partitionBy PartitionBy
+
+	// maxColumnsPerTable is the most columns (key + field) a single
+	// physical table is allowed to carry before field columns start
+	// spilling into "<table>_extN" overflow tables.
+	maxColumnsPerTable int
+}
+
+// NewManager returns a TableManager that creates tables using tableTemplate
+// (or tagTableTemplate, for tag tables) and tracks table/column existence
+// against db. DDL statements that fail with a transient error (a dropped
+// connection, a serialization failure, a deadlock) are retried up to
+// retries times with exponential backoff between retryInitialInterval and
+// retryMaxInterval; a zero value for any of the three falls back to a
+// sensible default. When partitionBy isn't PartitionNone, tableTemplate is
+// expected to declare the parent table as partitioned (e.g. via a
+// "PARTITION BY RANGE ({PARTITION_KEY})" clause) and child partitions are
+// created automatically as writes reach a new time range. maxColumnsPerTable
+// bounds how many columns a single physical table may carry before field
+// columns spill into overflow tables; a zero value falls back to
+// DefaultMaxColumnsPerTable.
+func NewManager(db db.Wrapper, schema, tableTemplate, tagTableTemplate string, retries int, retryInitialInterval, retryMaxInterval time.Duration, partitionBy PartitionBy, maxColumnsPerTable int) TableManager {
+	if retries == 0 {
+		retries = DefaultTableCreateRetries
+	}
+	if retryInitialInterval == 0 {
+		retryInitialInterval = DefaultTableCreateRetryInitialInterval
+	}
+	if retryMaxInterval == 0 {
+		retryMaxInterval = DefaultTableCreateRetryMaxInterval
+	}
+	if partitionBy == "" {
+		partitionBy = PartitionNone
+	}
+	if maxColumnsPerTable == 0 {
+		maxColumnsPerTable = DefaultMaxColumnsPerTable
+	}
+
+	return &defTableManager{
+		Tables:               make(map[string]map[string]bool),
+		db:                   db,
+		schema:               schema,
+		tableTemplate:        tableTemplate,
+		tagTableTemplate:     tagTableTemplate,
+		retries:              retries,
+		retryInitialInterval: retryInitialInterval,
+		retryMaxInterval:     retryMaxInterval,
+		partitionBy:          partitionBy,
+		maxColumnsPerTable:   maxColumnsPerTable,
+	}
+}
+
+// Exists reports whether tableName exists, consulting the cache first and
+// falling back to a database check. The database check selects one row from
+// the table, so an uncached table that exists but holds no rows is reported
+// as not existing.
+func (m *defTableManager) Exists(tableName string) bool {
+	if _, ok := m.Tables[tableName]; ok {
+		return true
+	}
+
+	result, err := m.db.Exec(fmt.Sprintf(`SELECT 1 FROM %s LIMIT 1`, m.quotedTableName(tableName)))
+	if err != nil {
+		return false
+	}
+	if result.RowsAffected() > 0 {
+		m.Tables[tableName] = m.loadColumns(tableName)
+		return true
+	}
+	return false
+}
+
+// CreateTable creates tableName using the configured template and the
+// columns described by colDetails, and marks all of those columns as
+// existing in the cache. When partitioning is enabled for metric (non-tag)
+// tables, it instead ensures the partitioned parent table and the child
+// partition covering ts both exist. If colDetails has more columns than
+// maxColumnsPerTable allows, the field columns are split across the base
+// table and one or more "<tableName>_extN" overflow tables, each carrying
+// the same key (time/tag) columns so rows can be joined back together; the
+// returned PlacementPlan describes that split. Tag tables are never split.
+func (m *defTableManager) CreateTable(tableName string, colDetails *utils.TargetColumns, ts time.Time) (*PlacementPlan, error) {
+	if colDetails.TagTable {
+		if err := m.createPlainTable(tableName, colDetails); err != nil {
+			return nil, err
+		}
+		return &PlacementPlan{Tables: []TablePlacement{{Table: tableName, Columns: allColumnIndexes(colDetails)}}}, nil
+	}
+
+	plan := buildPlacementPlan(tableName, colDetails, m.maxColumnsPerTable)
+
+	for _, placement := range plan.Tables {
+		sub := subColumns(colDetails, placement.Columns)
+
+		var err error
+		if m.partitioningEnabled() {
+			err = m.createPartitionedTable(placement.Table, sub, ts)
+		} else {
+			err = m.createPlainTable(placement.Table, sub)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return plan, nil
+}
+
+func allColumnIndexes(colDetails *utils.TargetColumns) []int {
+	indexes := make([]int, len(colDetails.Names))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	return indexes
+}
+
+func (m *defTableManager) createPlainTable(tableName string, colDetails *utils.TargetColumns) error {
+	template := m.tableTemplate
+	if colDetails.TagTable {
+		template = m.tagTableTemplate
+	}
+
+	query := m.expandTemplate(template, tableName, colDetails)
+	if _, err := m.execWithRetry(query); err != nil {
+		return err
+	}
+
+	cols := make(map[string]bool, len(colDetails.Names))
+	for _, name := range colDetails.Names {
+		cols[name] = true
+	}
+	m.Tables[tableName] = cols
+	return nil
+}
+
+// createPartitionedTable creates the partitioned parent table the first time
+// it's written to, then creates (if needed) and routes to the child
+// partition covering ts.
+func (m *defTableManager) createPartitionedTable(tableName string, colDetails *utils.TargetColumns, ts time.Time) error {
+	if _, ok := m.Tables[tableName]; !ok {
+		query := m.expandTemplate(m.tableTemplate, tableName, colDetails)
+		if _, err := m.execWithRetry(query); err != nil {
+			return err
+		}
+
+		cols := make(map[string]bool, len(colDetails.Names))
+		for _, name := range colDetails.Names {
+			cols[name] = true
+		}
+		m.Tables[tableName] = cols
+	}
+
+	from, to := partitionBounds(ts, m.partitionBy)
+	partitionName := fmt.Sprintf("%s_%s", tableName, from.Format("20060102"))
+	if _, ok := m.Tables[partitionName]; ok {
+		return nil
+	}
+
+	query := fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')`,
+		m.quotedTableName(partitionName), m.quotedTableName(tableName),
+		from.Format("2006-01-02"), to.Format("2006-01-02"),
+	)
+	if _, err := m.execWithRetry(query); err != nil {
+		return err
+	}
+
+	m.Tables[partitionName] = map[string]bool{}
+	return nil
+}
+
+func (m *defTableManager) partitioningEnabled() bool {
+	switch m.partitionBy {
+	case PartitionDaily, PartitionWeekly, PartitionMonthly:
+		return true
+	default:
+		return false
+	}
+}
+
+// partitionBounds returns the [from, to) range of the partition that ts
+// falls into for the given partitioning granularity.
+func partitionBounds(ts time.Time, by PartitionBy) (time.Time, time.Time) {
+	ts = ts.UTC()
+
+	switch by {
+	case PartitionWeekly:
+		// ISO week: Monday through Sunday.
+		offset := (int(ts.Weekday()) + 6) % 7
+		from := time.Date(ts.Year(), ts.Month(), ts.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -offset)
+		return from, from.AddDate(0, 0, 7)
+	case PartitionMonthly:
+		from := time.Date(ts.Year(), ts.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return from, from.AddDate(0, 1, 0)
+	default: // PartitionDaily
+		from := time.Date(ts.Year(), ts.Month(), ts.Day(), 0, 0, 0, 0, time.UTC)
+		return from, from.AddDate(0, 0, 1)
+	}
+}
+
+// partitionKeyColumn returns the quoted name of colDetails' time column,
+// which is what the parent table is range-partitioned on.
+func partitionKeyColumn(colDetails *utils.TargetColumns) string {
+	for i, role := range colDetails.Roles {
+		if role == utils.TimeColType {
+			return fmt.Sprintf(`"%s"`, colDetails.Names[i])
+		}
+	}
+	return `"time"`
+}
+
+// partitionIntervalLiteral returns the SQL interval literal corresponding to
+// by, for templates that need to pass it through to e.g. a
+// chunk_time_interval argument.
+func partitionIntervalLiteral(by PartitionBy) string {
+	switch by {
+	case PartitionWeekly:
+		return "1 week"
+	case PartitionMonthly:
+		return "1 month"
+	default:
+		return "1 day"
+	}
+}
+
+// expandTemplate fills in template's {TABLE}/{COLUMNS}/{PARTITION_KEY}/
+// {PARTITION_INTERVAL} placeholders for tableName and colDetails.
+func (m *defTableManager) expandTemplate(template, tableName string, colDetails *utils.TargetColumns) string {
+	return strings.NewReplacer(
+		"{TABLE}", m.quotedTableName(tableName),
+		"{COLUMNS}", m.columnDefinitions(colDetails),
+		"{PARTITION_KEY}", partitionKeyColumn(colDetails),
+		"{PARTITION_INTERVAL}", partitionIntervalLiteral(m.partitionBy),
+	).Replace(template)
+}
+
+// MissingColumns returns the indexes into target.Names/target.DataTypes of
+// columns that don't yet exist on tableName. If tableName's columns aren't
+// cached yet, they're queried from the database first.
+func (m *defTableManager) MissingColumns(tableName string, target *utils.TargetColumns) []int {
+	cols, ok := m.Tables[tableName]
+	if !ok {
+		cols = m.loadColumns(tableName)
+		// Only cache what was found: an entry in Tables marks the table as
+		// existing, and a table with no columns found may not exist at all.
+		if len(cols) > 0 {
+			m.Tables[tableName] = cols
+		}
+	}
+
+	var missing []int
+	for i, name := range target.Names {
+		if !cols[name] {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// AddColumns issues a single ALTER TABLE adding every column named by
+// missing (indexes into target.Names/target.DataTypes) to tableName.
+func (m *defTableManager) AddColumns(tableName string, target *utils.TargetColumns, missing []int) error {
+	if len(missing) == 0 {
+		return nil
+	}
+
+	adds := make([]string, 0, len(missing))
+	for _, i := range missing {
+		adds = append(adds, fmt.Sprintf(`ADD COLUMN IF NOT EXISTS "%s" %s`, target.Names[i], target.DataTypes[i]))
+	}
+
+	query := fmt.Sprintf(`ALTER TABLE %s %s`, m.quotedTableName(tableName), strings.Join(adds, ","))
+	if _, err := m.execWithRetry(query); err != nil {
+		return err
+	}
+
+	cols := m.Tables[tableName]
+	if cols == nil {
+		cols = make(map[string]bool, len(missing))
+	}
+	for _, i := range missing {
+		cols[target.Names[i]] = true
+	}
+	m.Tables[tableName] = cols
+	return nil
+}
+
+// EnsureColumns creates tableName if it doesn't exist yet, or otherwise adds
+// whatever columns in colDetails it's missing. ts is forwarded to
+// CreateTable to select the right partition when partitioning is enabled.
+// Like CreateTable, it's placement-aware: if colDetails has grown past
+// maxColumnsPerTable since tableName was created, the new columns spill
+// into "<tableName>_extN" overflow tables rather than being piled onto an
+// existing table past the cap.
+func (m *defTableManager) EnsureColumns(tableName string, colDetails *utils.TargetColumns, ts time.Time) (*PlacementPlan, error) {
+	if colDetails.TagTable {
+		// Check the cache directly rather than calling Exists: Exists falls
+		// back to a DB round-trip for an uncached table, but CreateTable's
+		// DDL is already idempotent (CREATE TABLE IF NOT EXISTS), so the
+		// round-trip would just be wasted on every first write.
+		if _, ok := m.Tables[tableName]; !ok {
+			return m.CreateTable(tableName, colDetails, ts)
+		}
+
+		missing := m.MissingColumns(tableName, colDetails)
+		if err := m.AddColumns(tableName, colDetails, missing); err != nil {
+			return nil, err
+		}
+		return &PlacementPlan{Tables: []TablePlacement{{Table: tableName, Columns: allColumnIndexes(colDetails)}}}, nil
+	}
+
+	plan := buildPlacementPlan(tableName, colDetails, m.maxColumnsPerTable)
+
+	for _, placement := range plan.Tables {
+		sub := subColumns(colDetails, placement.Columns)
+		// Same reasoning as the tag-table check above: consult the cache,
+		// not Exists, so a brand-new table's idempotent CREATE TABLE isn't
+		// preceded by a pointless existence probe.
+		_, known := m.Tables[placement.Table]
+
+		switch {
+		case m.partitioningEnabled():
+			// createPartitionedTable is idempotent: it no-ops once the
+			// parent and the partition covering ts both already exist.
+			if err := m.createPartitionedTable(placement.Table, sub, ts); err != nil {
+				return nil, err
+			}
+		case !known:
+			if err := m.createPlainTable(placement.Table, sub); err != nil {
+				return nil, err
+			}
+			continue // createPlainTable already has every column in sub.
+		}
+
+		missing := m.MissingColumns(placement.Table, sub)
+		if len(missing) == 0 {
+			continue
+		}
+		if err := m.AddColumns(placement.Table, sub, missing); err != nil {
+			return nil, err
+		}
+	}
+
+	return plan, nil
+}
+
+func (m *defTableManager) columnDefinitions(colDetails *utils.TargetColumns) string {
+	columns := make([]string, len(colDetails.Names))
+	for i, name := range colDetails.Names {
+		columns[i] = fmt.Sprintf(`"%s" %s`, name, colDetails.DataTypes[i])
+	}
+	return strings.Join(columns, ",")
+}
+
+func (m *defTableManager) quotedTableName(tableName string) string {
+	if m.schema == "" {
+		return fmt.Sprintf(`"%s"`, tableName)
+	}
+	return fmt.Sprintf(`"%s"."%s"`, m.schema, tableName)
+}
+
+// loadColumns queries information_schema for the columns that currently
+// exist on tableName.
+func (m *defTableManager) loadColumns(tableName string) map[string]bool {
+	cols := map[string]bool{}
+
+	rows, err := m.db.Query(
+		`SELECT column_name FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2`,
+		m.schema, tableName,
+	)
+	if err != nil || rows == nil {
+		return cols
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			continue
+		}
+		cols[name] = true
+	}
+	return cols
+}
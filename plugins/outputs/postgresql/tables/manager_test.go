@@ -2,7 +2,9 @@ package tables
 
 import (
 	"errors"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/influxdata/telegraf/plugins/outputs/postgresql/db"
 	"github.com/influxdata/telegraf/plugins/outputs/postgresql/utils"
@@ -10,14 +12,30 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// execResult is one scripted (CommandTag, error) pair for mockDb.Exec to
+// return, so tests can exercise retry logic deterministically.
+type execResult struct {
+	tag pgx.CommandTag
+	err error
+}
+
 type mockDb struct {
 	queriesSentToExec []string
 	exec              pgx.CommandTag
 	execErr           error
+
+	// execResults, if non-empty, is consumed one entry per call to Exec
+	// instead of always returning exec/execErr.
+	execResults []execResult
 }
 
 func (m *mockDb) Exec(query string, args ...interface{}) (pgx.CommandTag, error) {
 	m.queriesSentToExec = append(m.queriesSentToExec, query)
+	if len(m.execResults) > 0 {
+		res := m.execResults[0]
+		m.execResults = m.execResults[1:]
+		return res.tag, res.err
+	}
 	return m.exec, m.execErr
 }
 func (m *mockDb) DoCopy(fullTableName *pgx.Identifier, colNames []string, batch [][]interface{}) error {
@@ -35,13 +53,28 @@ func (m *mockDb) Close() error {
 
 func (m *mockDb) IsAlive() bool { return true }
 
+var testTime = time.Date(2021, 3, 15, 12, 0, 0, 0, time.UTC)
+
 func TestNewManager(t *testing.T) {
 	db := &mockDb{}
-	res := NewManager(db, "schema", "table template", "tag table template").(*defTableManager)
+	res := NewManager(db, "schema", "table template", "tag table template", 5, 10*time.Millisecond, time.Second, PartitionDaily, 500).(*defTableManager)
 	assert.Equal(t, "table template", res.tableTemplate)
 	assert.Equal(t, "schema", res.schema)
 	assert.Equal(t, "tag table template", res.tagTableTemplate)
 	assert.Equal(t, db, res.db)
+	assert.Equal(t, 5, res.retries)
+	assert.Equal(t, 10*time.Millisecond, res.retryInitialInterval)
+	assert.Equal(t, time.Second, res.retryMaxInterval)
+	assert.Equal(t, PartitionDaily, res.partitionBy)
+}
+
+func TestNewManagerDefaultsRetrySettings(t *testing.T) {
+	db := &mockDb{}
+	res := NewManager(db, "schema", "table template", "tag table template", 0, 0, 0, "", 0).(*defTableManager)
+	assert.Equal(t, DefaultTableCreateRetries, res.retries)
+	assert.Equal(t, DefaultTableCreateRetryInitialInterval, res.retryInitialInterval)
+	assert.Equal(t, DefaultTableCreateRetryMaxInterval, res.retryMaxInterval)
+	assert.Equal(t, PartitionNone, res.partitionBy)
 }
 
 func TestExists(t *testing.T) {
@@ -50,28 +83,28 @@ func TestExists(t *testing.T) {
 		in    string
 		out   bool
 		db    *mockDb
-		cache map[string]bool
+		cache map[string]map[string]bool
 	}{
 		{
 			desc:  "table already cached",
 			in:    "table",
 			db:    &mockDb{execErr: errors.New("should not have called exec")},
-			cache: map[string]bool{"table": true},
+			cache: map[string]map[string]bool{"table": {}},
 			out:   true,
 		}, {
 			desc:  "table not cached, error on check db",
-			cache: map[string]bool{},
+			cache: map[string]map[string]bool{},
 			in:    "table",
 			db:    &mockDb{execErr: errors.New("error on exec")},
 		}, {
 			desc:  "table not cached, exists in db",
-			cache: map[string]bool{},
+			cache: map[string]map[string]bool{},
 			in:    "table",
 			db:    &mockDb{exec: "0 1"},
 			out:   true,
 		}, {
 			desc:  "table not cached, doesn't exist",
-			cache: map[string]bool{},
+			cache: map[string]map[string]bool{},
 			in:    "table",
 			db:    &mockDb{exec: "0 0"},
 			out:   false,
@@ -147,15 +180,19 @@ func TestCreateTable(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
 			manager := &defTableManager{
-				Tables:           map[string]bool{},
+				Tables:           map[string]map[string]bool{},
 				db:               tc.db,
 				tableTemplate:    tc.template,
 				tagTableTemplate: tc.tagTempalate,
 			}
-			got := manager.CreateTable(tc.inT, tc.inCD)
+			_, got := manager.CreateTable(tc.inT, tc.inCD, testTime)
 			assert.Equal(t, tc.out, got)
 			if tc.out == nil {
-				assert.True(t, manager.Tables[tc.inT])
+				cols, ok := manager.Tables[tc.inT]
+				assert.True(t, ok)
+				for _, name := range tc.inCD.Names {
+					assert.True(t, cols[name])
+				}
 			}
 			if tc.expectQ != "" {
 				assert.Equal(t, tc.expectQ, tc.db.(*mockDb).queriesSentToExec[0])
@@ -163,3 +200,470 @@ func TestCreateTable(t *testing.T) {
 		})
 	}
 }
+
+func TestCreateTablePartitioned(t *testing.T) {
+	colDetails := &utils.TargetColumns{
+		Names:     []string{"time", "t", "f"},
+		Target:    map[string]int{"time": 0, "t": 1, "f": 2},
+		DataTypes: []utils.PgDataType{"timestamptz", "text", "float8"},
+		Roles:     []utils.ColumnRole{utils.TimeColType, utils.TagColType, utils.FieldColType},
+	}
+
+	t.Run("first write creates parent and child partition", func(t *testing.T) {
+		db := &mockDb{}
+		manager := &defTableManager{
+			Tables:        map[string]map[string]bool{},
+			db:            db,
+			tableTemplate: "CREATE TABLE IF NOT EXISTS {TABLE}({COLUMNS}) PARTITION BY RANGE ({PARTITION_KEY})",
+			partitionBy:   PartitionDaily,
+		}
+
+		_, err := manager.CreateTable("m", colDetails, testTime)
+		assert.NoError(t, err)
+		assert.Equal(t,
+			`CREATE TABLE IF NOT EXISTS "m"("time" timestamptz,"t" text,"f" float8) PARTITION BY RANGE ("time")`,
+			db.queriesSentToExec[0],
+		)
+		assert.Equal(t,
+			`CREATE TABLE IF NOT EXISTS "m_20210315" PARTITION OF "m" FOR VALUES FROM ('2021-03-15') TO ('2021-03-16')`,
+			db.queriesSentToExec[1],
+		)
+		assert.True(t, manager.Tables["m_20210315"] != nil)
+	})
+
+	t.Run("second write in same day only touches cache, no DDL", func(t *testing.T) {
+		db := &mockDb{}
+		manager := &defTableManager{
+			Tables: map[string]map[string]bool{
+				"m":          {"time": true, "t": true, "f": true},
+				"m_20210315": {},
+			},
+			db:          db,
+			partitionBy: PartitionDaily,
+		}
+
+		_, err := manager.CreateTable("m", colDetails, testTime)
+		assert.NoError(t, err)
+		assert.Empty(t, db.queriesSentToExec)
+	})
+
+	t.Run("write to a new day creates a new partition", func(t *testing.T) {
+		db := &mockDb{}
+		manager := &defTableManager{
+			Tables: map[string]map[string]bool{
+				"m":          {"time": true, "t": true, "f": true},
+				"m_20210315": {},
+			},
+			db:          db,
+			partitionBy: PartitionDaily,
+		}
+
+		_, err := manager.CreateTable("m", colDetails, testTime.AddDate(0, 0, 1))
+		assert.NoError(t, err)
+		assert.Equal(t,
+			`CREATE TABLE IF NOT EXISTS "m_20210316" PARTITION OF "m" FOR VALUES FROM ('2021-03-16') TO ('2021-03-17')`,
+			db.queriesSentToExec[0],
+		)
+	})
+
+	t.Run("tag tables are never partitioned", func(t *testing.T) {
+		db := &mockDb{}
+		manager := &defTableManager{
+			Tables:           map[string]map[string]bool{},
+			db:               db,
+			tagTableTemplate: "CREATE TABLE IF NOT EXISTS {TABLE}({COLUMNS})",
+			partitionBy:      PartitionDaily,
+		}
+
+		tagCD := &utils.TargetColumns{
+			Names:     []string{"tagId", "t"},
+			Target:    map[string]int{"tagId": 0, "t": 1},
+			DataTypes: []utils.PgDataType{"serial", "text"},
+			Roles:     []utils.ColumnRole{utils.TagsIDColType, utils.TagColType},
+			TagTable:  true,
+		}
+
+		_, err := manager.CreateTable("m_tag", tagCD, testTime)
+		assert.NoError(t, err)
+		assert.Equal(t, `CREATE TABLE IF NOT EXISTS "m_tag"("tagId" serial,"t" text)`, db.queriesSentToExec[0])
+		assert.Len(t, db.queriesSentToExec, 1)
+	})
+}
+
+// wideTargetColumns builds a TargetColumns for a "time" column, a "t" tag
+// column, and numFields field columns named f0..fN-1.
+func wideTargetColumns(numFields int) *utils.TargetColumns {
+	names := []string{"time", "t"}
+	roles := []utils.ColumnRole{utils.TimeColType, utils.TagColType}
+	dataTypes := []utils.PgDataType{"timestamptz", "text"}
+	for i := 0; i < numFields; i++ {
+		names = append(names, fmt.Sprintf("f%d", i))
+		roles = append(roles, utils.FieldColType)
+		dataTypes = append(dataTypes, "float8")
+	}
+
+	target := make(map[string]int, len(names))
+	for i, name := range names {
+		target[name] = i
+	}
+
+	return &utils.TargetColumns{Names: names, Target: target, DataTypes: dataTypes, Roles: roles}
+}
+
+func TestBuildPlacementPlan(t *testing.T) {
+	// 2 key columns (time, t) + 1200 fields, capped at 500 columns/table:
+	// each table can hold 498 fields alongside the 2 key columns.
+	colDetails := wideTargetColumns(1200)
+
+	plan := buildPlacementPlan("m", colDetails, 500)
+
+	wantTables := []string{"m", "m_ext1", "m_ext2"}
+	wantFieldCounts := []int{498, 498, 204} // 498+498+204 == 1200
+	assert.Len(t, plan.Tables, len(wantTables))
+
+	seenFields := 0
+	for i, placement := range plan.Tables {
+		assert.Equal(t, wantTables[i], placement.Table)
+		assert.LessOrEqual(t, len(placement.Columns), 500)
+		// every table must carry the key columns to join back together.
+		assert.Contains(t, placement.Columns, colDetails.Target["time"])
+		assert.Contains(t, placement.Columns, colDetails.Target["t"])
+
+		fieldCount := 0
+		for _, idx := range placement.Columns {
+			if colDetails.Roles[idx] == utils.FieldColType {
+				fieldCount++
+			}
+		}
+		assert.Equal(t, wantFieldCounts[i], fieldCount)
+		seenFields += fieldCount
+	}
+	assert.Equal(t, 1200, seenFields)
+}
+
+func TestCreateTableOverflow(t *testing.T) {
+	colDetails := wideTargetColumns(1200)
+
+	db := &mockDb{}
+	manager := &defTableManager{
+		Tables:             map[string]map[string]bool{},
+		db:                 db,
+		tableTemplate:      "CREATE TABLE IF NOT EXISTS {TABLE}({COLUMNS})",
+		maxColumnsPerTable: 500,
+	}
+
+	plan, err := manager.CreateTable("m", colDetails, testTime)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"m", "m_ext1", "m_ext2"}, []string{
+		plan.Tables[0].Table, plan.Tables[1].Table, plan.Tables[2].Table,
+	})
+	assert.Len(t, db.queriesSentToExec, 3)
+
+	for _, tableName := range []string{"m", "m_ext1", "m_ext2"} {
+		cols, ok := manager.Tables[tableName]
+		assert.True(t, ok)
+		assert.True(t, cols["time"])
+		assert.True(t, cols["t"])
+	}
+}
+
+func TestPartitionBounds(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		by       PartitionBy
+		ts       time.Time
+		wantFrom string
+		wantTo   string
+	}{
+		{desc: "daily", by: PartitionDaily, ts: testTime, wantFrom: "2021-03-15", wantTo: "2021-03-16"},
+		{desc: "weekly", by: PartitionWeekly, ts: testTime, wantFrom: "2021-03-15", wantTo: "2021-03-22"},
+		{desc: "monthly", by: PartitionMonthly, ts: testTime, wantFrom: "2021-03-01", wantTo: "2021-04-01"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			from, to := partitionBounds(tc.ts, tc.by)
+			assert.Equal(t, tc.wantFrom, from.Format("2006-01-02"))
+			assert.Equal(t, tc.wantTo, to.Format("2006-01-02"))
+		})
+	}
+}
+
+func TestMissingColumns(t *testing.T) {
+	target := &utils.TargetColumns{
+		Names:     []string{"time", "t", "f", "f2"},
+		Target:    map[string]int{"time": 0, "t": 1, "f": 2, "f2": 3},
+		DataTypes: []utils.PgDataType{"timestamptz", "text", "float8", "float8"},
+		Roles:     []utils.ColumnRole{utils.TimeColType, utils.TagColType, utils.FieldColType, utils.FieldColType},
+	}
+
+	t.Run("table cached, one column missing", func(t *testing.T) {
+		manager := &defTableManager{
+			Tables: map[string]map[string]bool{
+				"m": {"time": true, "t": true, "f": true},
+			},
+			db: &mockDb{execErr: errors.New("should not have queried db")},
+		}
+
+		got := manager.MissingColumns("m", target)
+		assert.Equal(t, []int{3}, got)
+	})
+
+	t.Run("table not cached, columns loaded from db", func(t *testing.T) {
+		manager := &defTableManager{
+			Tables: map[string]map[string]bool{},
+			db:     &mockDb{},
+		}
+
+		got := manager.MissingColumns("m", target)
+		assert.Equal(t, []int{0, 1, 2, 3}, got)
+	})
+}
+
+func TestAddColumns(t *testing.T) {
+	target := &utils.TargetColumns{
+		Names:     []string{"time", "t", "f", "f2"},
+		Target:    map[string]int{"time": 0, "t": 1, "f": 2, "f2": 3},
+		DataTypes: []utils.PgDataType{"timestamptz", "text", "float8", "float8"},
+		Roles:     []utils.ColumnRole{utils.TimeColType, utils.TagColType, utils.FieldColType, utils.FieldColType},
+	}
+
+	t.Run("no missing columns is a no-op", func(t *testing.T) {
+		db := &mockDb{execErr: errors.New("should not have called exec")}
+		manager := &defTableManager{Tables: map[string]map[string]bool{}, db: db}
+
+		err := manager.AddColumns("m", target, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, db.queriesSentToExec)
+	})
+
+	t.Run("issues a single ALTER TABLE for all missing columns", func(t *testing.T) {
+		db := &mockDb{}
+		manager := &defTableManager{
+			Tables: map[string]map[string]bool{"m": {"time": true, "t": true}},
+			db:     db,
+		}
+
+		err := manager.AddColumns("m", target, []int{2, 3})
+		assert.NoError(t, err)
+		assert.Equal(t,
+			`ALTER TABLE "m" ADD COLUMN IF NOT EXISTS "f" float8,ADD COLUMN IF NOT EXISTS "f2" float8`,
+			db.queriesSentToExec[0],
+		)
+		assert.True(t, manager.Tables["m"]["f"])
+		assert.True(t, manager.Tables["m"]["f2"])
+	})
+
+	t.Run("exec error is propagated and cache is left untouched", func(t *testing.T) {
+		db := &mockDb{execErr: errors.New("error on exec")}
+		manager := &defTableManager{
+			Tables: map[string]map[string]bool{"m": {"time": true, "t": true}},
+			db:     db,
+		}
+
+		err := manager.AddColumns("m", target, []int{2})
+		assert.EqualError(t, err, "error on exec")
+		assert.False(t, manager.Tables["m"]["f"])
+	})
+}
+
+func TestEnsureColumns(t *testing.T) {
+	target := &utils.TargetColumns{
+		Names:     []string{"time", "t", "f"},
+		Target:    map[string]int{"time": 0, "t": 1, "f": 2},
+		DataTypes: []utils.PgDataType{"timestamptz", "text", "float8"},
+		Roles:     []utils.ColumnRole{utils.TimeColType, utils.TagColType, utils.FieldColType},
+	}
+
+	t.Run("creates the table when it doesn't exist", func(t *testing.T) {
+		db := &mockDb{exec: "0 0"}
+		manager := &defTableManager{
+			Tables:        map[string]map[string]bool{},
+			db:            db,
+			tableTemplate: "CREATE TABLE IF NOT EXISTS {TABLE}({COLUMNS})",
+		}
+
+		_, err := manager.EnsureColumns("m", target, testTime)
+		assert.NoError(t, err)
+		assert.Equal(t, `CREATE TABLE IF NOT EXISTS "m"("time" timestamptz,"t" text,"f" float8)`, db.queriesSentToExec[0])
+	})
+
+	t.Run("adds missing columns when the table exists", func(t *testing.T) {
+		db := &mockDb{}
+		manager := &defTableManager{
+			Tables: map[string]map[string]bool{"m": {"time": true, "t": true}},
+			db:     db,
+		}
+
+		_, err := manager.EnsureColumns("m", target, testTime)
+		assert.NoError(t, err)
+		assert.Equal(t, `ALTER TABLE "m" ADD COLUMN IF NOT EXISTS "f" float8`, db.queriesSentToExec[0])
+	})
+
+	t.Run("migrates new columns onto an already-partitioned table", func(t *testing.T) {
+		db := &mockDb{}
+		manager := &defTableManager{
+			Tables: map[string]map[string]bool{
+				"m":          {"time": true, "t": true, "f": true},
+				"m_20210315": {},
+			},
+			db:                 db,
+			partitionBy:        PartitionDaily,
+			maxColumnsPerTable: 500,
+		}
+
+		widened := &utils.TargetColumns{
+			Names:     []string{"time", "t", "f", "f2"},
+			Target:    map[string]int{"time": 0, "t": 1, "f": 2, "f2": 3},
+			DataTypes: []utils.PgDataType{"timestamptz", "text", "float8", "float8"},
+			Roles:     []utils.ColumnRole{utils.TimeColType, utils.TagColType, utils.FieldColType, utils.FieldColType},
+		}
+
+		_, err := manager.EnsureColumns("m", widened, testTime)
+		assert.NoError(t, err)
+		assert.Equal(t, `ALTER TABLE "m" ADD COLUMN IF NOT EXISTS "f2" float8`, db.queriesSentToExec[0])
+		assert.True(t, manager.Tables["m"]["f2"])
+	})
+}
+
+// cachedColumns returns the set of column names from colDetails[:n], as would
+// be cached for a table that was created before colDetails grew to its
+// current width.
+func cachedColumns(colDetails *utils.TargetColumns, n int) map[string]bool {
+	cols := make(map[string]bool, n)
+	for _, name := range colDetails.Names[:n] {
+		cols[name] = true
+	}
+	return cols
+}
+
+func TestEnsureColumnsOverflow(t *testing.T) {
+	// 2 key columns (time, t) + 500 fields, capped at 500 columns/table: "m"
+	// can only hold 498 of the fields, so the rest must land in "m_ext1".
+	colDetails := wideTargetColumns(500)
+
+	testCases := []struct {
+		desc         string
+		tables       map[string]map[string]bool
+		wantTables   []string
+		wantQueries  int
+		wantExtQuery string
+	}{
+		{
+			desc: "spills new columns into a new overflow table once the base table is at the cap",
+			tables: map[string]map[string]bool{
+				"m": cachedColumns(colDetails, 500), // time, t, f0..f497: already at the 498-field cap.
+			},
+			wantTables:   []string{"m", "m_ext1"},
+			wantQueries:  1,
+			wantExtQuery: `CREATE TABLE IF NOT EXISTS "m_ext1"("time" timestamptz,"t" text,"f498" float8,"f499" float8)`,
+		},
+		{
+			desc: "adds missing columns onto an already-existing overflow table",
+			tables: map[string]map[string]bool{
+				"m":      cachedColumns(colDetails, 500),
+				"m_ext1": {"time": true, "t": true, "f498": true},
+			},
+			wantTables:   []string{"m", "m_ext1"},
+			wantQueries:  1,
+			wantExtQuery: `ALTER TABLE "m_ext1" ADD COLUMN IF NOT EXISTS "f499" float8`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			db := &mockDb{}
+			manager := &defTableManager{
+				Tables:             tc.tables,
+				db:                 db,
+				tableTemplate:      "CREATE TABLE IF NOT EXISTS {TABLE}({COLUMNS})",
+				maxColumnsPerTable: 500,
+			}
+
+			plan, err := manager.EnsureColumns("m", colDetails, testTime)
+			assert.NoError(t, err)
+
+			gotTables := make([]string, len(plan.Tables))
+			for i, placement := range plan.Tables {
+				gotTables[i] = placement.Table
+			}
+			assert.Equal(t, tc.wantTables, gotTables)
+
+			assert.Len(t, db.queriesSentToExec, tc.wantQueries)
+			assert.Equal(t, tc.wantExtQuery, db.queriesSentToExec[0])
+			for _, q := range db.queriesSentToExec {
+				assert.NotContains(t, q, "SELECT", "EnsureColumns should never probe for a table's existence; the DDL it issues is already idempotent")
+			}
+			assert.True(t, manager.Tables["m_ext1"]["f499"])
+		})
+	}
+}
+
+func TestIsTransientPgError(t *testing.T) {
+	testCases := []struct {
+		desc string
+		err  error
+		out  bool
+	}{
+		{desc: "deadlock is transient", err: pgx.PgError{Code: "40P01"}, out: true},
+		{desc: "serialization failure is transient", err: pgx.PgError{Code: "40001"}, out: true},
+		{desc: "object in use is transient", err: pgx.PgError{Code: "55006"}, out: true},
+		{desc: "connection failure is transient", err: pgx.PgError{Code: "08006"}, out: true},
+		{desc: "syntax error is permanent", err: pgx.PgError{Code: "42601"}, out: false},
+		{desc: "permission denied is permanent", err: pgx.PgError{Code: "42501"}, out: false},
+		{desc: "unstructured error defaults to permanent", err: errors.New("connection reset by peer"), out: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.out, isTransientPgError(tc.err))
+		})
+	}
+}
+
+func TestExecWithRetry(t *testing.T) {
+	t.Run("succeeds first try", func(t *testing.T) {
+		db := &mockDb{exec: "0 1"}
+		manager := &defTableManager{db: db, retries: 3, retryInitialInterval: time.Millisecond, retryMaxInterval: time.Millisecond}
+
+		tag, err := manager.execWithRetry("query")
+		assert.NoError(t, err)
+		assert.EqualValues(t, "0 1", tag)
+		assert.Len(t, db.queriesSentToExec, 1)
+	})
+
+	t.Run("retries transient errors until success", func(t *testing.T) {
+		db := &mockDb{execResults: []execResult{
+			{err: pgx.PgError{Code: "40P01"}},
+			{err: pgx.PgError{Code: "40001"}},
+			{tag: "0 1"},
+		}}
+		manager := &defTableManager{db: db, retries: 3, retryInitialInterval: time.Millisecond, retryMaxInterval: time.Millisecond}
+
+		tag, err := manager.execWithRetry("query")
+		assert.NoError(t, err)
+		assert.EqualValues(t, "0 1", tag)
+		assert.Len(t, db.queriesSentToExec, 3)
+	})
+
+	t.Run("does not retry permanent errors", func(t *testing.T) {
+		db := &mockDb{execResults: []execResult{
+			{err: pgx.PgError{Code: "42601"}},
+			{tag: "0 1"},
+		}}
+		manager := &defTableManager{db: db, retries: 3, retryInitialInterval: time.Millisecond, retryMaxInterval: time.Millisecond}
+
+		_, err := manager.execWithRetry("query")
+		assert.EqualError(t, err, pgx.PgError{Code: "42601"}.Error())
+		assert.Len(t, db.queriesSentToExec, 1)
+	})
+
+	t.Run("gives up after exhausting retries", func(t *testing.T) {
+		db := &mockDb{execErr: pgx.PgError{Code: "40001"}}
+		manager := &defTableManager{db: db, retries: 2, retryInitialInterval: time.Millisecond, retryMaxInterval: time.Millisecond}
+
+		_, err := manager.execWithRetry("query")
+		assert.Error(t, err)
+		assert.Len(t, db.queriesSentToExec, 3)
+	})
+}
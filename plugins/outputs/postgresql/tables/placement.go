@@ -0,0 +1,106 @@
+package tables
+
+import (
+	"fmt"
+
+	"github.com/influxdata/telegraf/plugins/outputs/postgresql/utils"
+)
+
+// DefaultMaxColumnsPerTable is used when NewManager is given a zero value
+// for maxColumnsPerTable. It's comfortably under PostgreSQL's hard 1600
+// column limit, which is often configured even lower in production.
+const DefaultMaxColumnsPerTable = 1000
+
+// TablePlacement is one physical table a metric's columns should be written
+// to: tableName plus the indexes (into the originating TargetColumns) of
+// the columns that land there.
+type TablePlacement struct {
+	Table   string
+	Columns []int
+}
+
+// PlacementPlan describes how a metric's columns are split across one or
+// more physical tables to keep each one at or below the manager's
+// maxColumnsPerTable. Every
+// table in the plan carries the key columns (time and tags), so the
+// writer can join rows written to different tables back together; field
+// columns are spread across the tables in order, filling the base table
+// first and spilling into "<table>_ext1", "<table>_ext2", etc. as needed.
+type PlacementPlan struct {
+	Tables []TablePlacement
+}
+
+// buildPlacementPlan splits colDetails' columns across one or more tables
+// named off of tableName so that none of them exceeds maxColumns. If the key
+// (non-field) columns alone already reach maxColumns, each table instead
+// carries all key columns plus one field column, and so exceeds maxColumns.
+func buildPlacementPlan(tableName string, colDetails *utils.TargetColumns, maxColumns int) *PlacementPlan {
+	var keyIdx, fieldIdx []int
+	for i, role := range colDetails.Roles {
+		if role == utils.FieldColType {
+			fieldIdx = append(fieldIdx, i)
+		} else {
+			keyIdx = append(keyIdx, i)
+		}
+	}
+
+	fieldCapacity := maxColumns - len(keyIdx)
+	if fieldCapacity < 1 {
+		fieldCapacity = 1
+	}
+
+	plan := &PlacementPlan{}
+	for ext := 0; ; ext++ {
+		start := ext * fieldCapacity
+		if start >= len(fieldIdx) && ext > 0 {
+			break
+		}
+		end := start + fieldCapacity
+		if end > len(fieldIdx) {
+			end = len(fieldIdx)
+		}
+
+		columns := append(append([]int{}, keyIdx...), fieldIdx[start:end]...)
+		plan.Tables = append(plan.Tables, TablePlacement{
+			Table:   extTableName(tableName, ext),
+			Columns: columns,
+		})
+
+		if end >= len(fieldIdx) {
+			break
+		}
+	}
+
+	return plan
+}
+
+// extTableName returns the physical table name for the ext'th chunk of
+// tableName's columns: tableName itself for ext == 0, "<tableName>_extN"
+// otherwise.
+func extTableName(tableName string, ext int) string {
+	if ext == 0 {
+		return tableName
+	}
+	return fmt.Sprintf("%s_ext%d", tableName, ext)
+}
+
+// subColumns builds the TargetColumns for just the given indexes into
+// colDetails, renumbering Target to match.
+func subColumns(colDetails *utils.TargetColumns, indexes []int) *utils.TargetColumns {
+	sub := &utils.TargetColumns{
+		Names:     make([]string, len(indexes)),
+		Target:    make(map[string]int, len(indexes)),
+		DataTypes: make([]utils.PgDataType, len(indexes)),
+		Roles:     make([]utils.ColumnRole, len(indexes)),
+	}
+
+	for newIdx, oldIdx := range indexes {
+		name := colDetails.Names[oldIdx]
+		sub.Names[newIdx] = name
+		sub.Target[name] = newIdx
+		sub.DataTypes[newIdx] = colDetails.DataTypes[oldIdx]
+		sub.Roles[newIdx] = colDetails.Roles[oldIdx]
+	}
+
+	return sub
+}
@@ -0,0 +1,57 @@
+package tables
+
+import (
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// Transient PostgreSQL error codes (SQLSTATE) that are worth retrying:
+// connection loss, serialization failures under concurrent DDL, deadlocks,
+// and locks momentarily held by someone else. Anything else - a syntax
+// error, a permissions problem, a missing object - is permanent and is
+// returned to the caller immediately.
+var transientPgErrorCodes = map[string]bool{
+	"08000": true, // connection_exception
+	"08003": true, // connection_does_not_exist
+	"08006": true, // connection_failure
+	"08001": true, // sqlclient_unable_to_establish_sqlconnection
+	"08004": true, // sqlserver_rejected_establishment_of_sqlconnection
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+	"55006": true, // object_in_use
+}
+
+// isTransientPgError reports whether err represents a condition worth
+// retrying. Only structured PostgreSQL errors with one of the codes above
+// are retried; anything else - an unstructured error that isn't even a
+// pgx.PgError - is assumed permanent and returned to the caller immediately
+// rather than retried blind.
+func isTransientPgError(err error) bool {
+	pgErr, ok := err.(pgx.PgError)
+	if !ok {
+		return false
+	}
+	return transientPgErrorCodes[pgErr.Code]
+}
+
+// execWithRetry runs query through m.db.Exec, retrying transient failures
+// with exponential backoff (starting at retryInitialInterval, capped at
+// retryMaxInterval) up to m.retries additional times. Permanent errors, and
+// transient errors that exhaust the retry budget, are returned as-is.
+func (m *defTableManager) execWithRetry(query string) (pgx.CommandTag, error) {
+	interval := m.retryInitialInterval
+
+	for attempt := 0; ; attempt++ {
+		tag, err := m.db.Exec(query)
+		if err == nil || attempt >= m.retries || !isTransientPgError(err) {
+			return tag, err
+		}
+
+		time.Sleep(interval)
+		interval *= 2
+		if interval > m.retryMaxInterval {
+			interval = m.retryMaxInterval
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package utils
+
+// PgDataType is a PostgreSQL column type name, e.g. "text" or "timestamptz".
+type PgDataType string
+
+// ColumnRole describes what a column is used for in a metric's target table,
+// so that table/column management code doesn't need to special-case columns
+// by name.
+type ColumnRole int
+
+const (
+	TimeColType ColumnRole = iota
+	TagColType
+	FieldColType
+	TagsIDColType
+)
+
+// TargetColumns describes the physical columns a metric batch should be
+// written to: the column names, their PostgreSQL types, what role each plays,
+// and a name->index lookup. TagTable is set when these columns describe a
+// tag table (used when tags are stored normalized in a separate table) rather
+// than a metric table.
+type TargetColumns struct {
+	Names     []string
+	Target    map[string]int
+	DataTypes []PgDataType
+	Roles     []ColumnRole
+	TagTable  bool
+}